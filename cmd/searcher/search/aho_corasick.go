@@ -0,0 +1,193 @@
+package search
+
+import (
+	"sort"
+)
+
+// This file implements a minimal Aho-Corasick automaton: the matcher
+// backend for fixed-string and multi-pattern queries. Building one
+// automaton per request and streaming each file's bytes through it once
+// is the "platinum searcher/sift"-style engine the old TODO on search()
+// asked for, without pulling in an external dependency for it.
+
+// acNode is one state of the automaton.
+type acNode struct {
+	children map[byte]*acNode
+	fail     *acNode
+	output   []int // indices into ahoCorasick.patterns ending at this state
+}
+
+// ahoCorasick matches a fixed set of patterns against a byte stream in a
+// single pass, regardless of how many patterns there are.
+type ahoCorasick struct {
+	root     *acNode
+	patterns [][]byte
+}
+
+// newAhoCorasick builds the automaton for patterns. If caseSensitive is
+// false, every pattern is folded to lowercase with bytesToLower (ASCII
+// letters only); callers must fold the haystack the same way before
+// matching.
+func newAhoCorasick(patterns []string, caseSensitive bool) *ahoCorasick {
+	ac := &ahoCorasick{
+		root:     &acNode{children: make(map[byte]*acNode)},
+		patterns: make([][]byte, len(patterns)),
+	}
+	for i, p := range patterns {
+		b := []byte(p)
+		if !caseSensitive {
+			b = bytesToLower(b)
+		}
+		ac.patterns[i] = b
+	}
+	ac.build()
+	return ac
+}
+
+func (ac *ahoCorasick) build() {
+	for i, p := range ac.patterns {
+		n := ac.root
+		for _, b := range p {
+			child, ok := n.children[b]
+			if !ok {
+				child = &acNode{children: make(map[byte]*acNode)}
+				n.children[b] = child
+			}
+			n = child
+		}
+		n.output = append(n.output, i)
+	}
+
+	// Breadth-first over the trie to compute failure links and merge in
+	// each state's failure target's output, so at match time a state's own
+	// output already lists every pattern ending there, with no walk along
+	// acNode.fail needed.
+	queue := make([]*acNode, 0, len(ac.root.children))
+	for _, child := range ac.root.children {
+		child.fail = ac.root
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for b, child := range n.children {
+			queue = append(queue, child)
+
+			v := n.fail
+			for v != ac.root {
+				if _, ok := v.children[b]; ok {
+					break
+				}
+				v = v.fail
+			}
+			if next, ok := v.children[b]; ok && next != child {
+				child.fail = next
+			} else {
+				child.fail = ac.root
+			}
+			child.output = append(child.output, child.fail.output...)
+		}
+	}
+}
+
+// step advances the automaton by one byte from state n, following
+// failure links as needed.
+func (ac *ahoCorasick) step(n *acNode, b byte) *acNode {
+	for n != ac.root {
+		if child, ok := n.children[b]; ok {
+			return child
+		}
+		n = n.fail
+	}
+	if child, ok := ac.root.children[b]; ok {
+		return child
+	}
+	return ac.root
+}
+
+// match streams data through the automaton once, calling hit for every
+// (patternIndex, endOffset) occurrence.
+func (ac *ahoCorasick) match(data []byte, hit func(patternIndex, end int)) {
+	n := ac.root
+	for i, b := range data {
+		n = ac.step(n, b)
+		for _, pi := range n.output {
+			hit(pi, i+1)
+		}
+	}
+}
+
+// ahoCorasickMatcher is the Matcher backend for fixed-string (and
+// multi-pattern) queries.
+type ahoCorasickMatcher struct {
+	ac            *ahoCorasick
+	caseSensitive bool
+}
+
+func newAhoCorasickMatcher(patterns []string, caseSensitive bool) *ahoCorasickMatcher {
+	return &ahoCorasickMatcher{ac: newAhoCorasick(patterns, caseSensitive), caseSensitive: caseSensitive}
+}
+
+func (m *ahoCorasickMatcher) Match(content []byte) ([]LineMatch, error) {
+	haystack := content
+	if !m.caseSensitive {
+		haystack = bytesToLower(content)
+	}
+
+	type hit struct{ patternIndex, start, end int }
+	var hits []hit
+	m.ac.match(haystack, func(patternIndex, end int) {
+		start := end - len(m.ac.patterns[patternIndex])
+		hits = append(hits, hit{patternIndex, start, end})
+	})
+	if len(hits) == 0 {
+		return nil, nil
+	}
+
+	lineStarts := lineStartOffsets(content)
+	byLine := make(map[int][][2]int)
+	for _, h := range hits {
+		line := lineForOffset(lineStarts, h.start)
+		byLine[line] = append(byLine[line], [2]int{h.start - lineStarts[line], h.end - h.start})
+	}
+
+	lines := make([]int, 0, len(byLine))
+	for line := range byLine {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+
+	matches := make([]LineMatch, 0, len(lines))
+	for _, line := range lines {
+		lineEnd := len(content)
+		if line+1 < len(lineStarts) {
+			lineEnd = lineStarts[line+1] - 1 // exclude the trailing newline
+		}
+		offs := byLine[line]
+		sort.Slice(offs, func(i, j int) bool { return offs[i][0] < offs[j][0] })
+		matches = append(matches, LineMatch{
+			Preview:          string(content[lineStarts[line]:lineEnd]),
+			LineNumber:       line + 1,
+			OffsetAndLengths: offs,
+		})
+	}
+	return matches, nil
+}
+
+// lineStartOffsets returns the byte offset each line of content starts
+// at, indexed by (0-based) line number.
+func lineStartOffsets(content []byte) []int {
+	starts := []int{0}
+	for i, b := range content {
+		if b == '\n' {
+			starts = append(starts, i+1)
+		}
+	}
+	return starts
+}
+
+// lineForOffset returns the (0-based) line number offset falls within,
+// given the line start table lineStartOffsets built.
+func lineForOffset(lineStarts []int, offset int) int {
+	return sort.Search(len(lineStarts), func(i int) bool { return lineStarts[i] > offset }) - 1
+}
@@ -0,0 +1,88 @@
+package search
+
+import "testing"
+
+func TestAhoCorasickMatch(t *testing.T) {
+	ac := newAhoCorasick([]string{"he", "she", "his", "hers"}, true)
+
+	var got []struct {
+		pattern string
+		end     int
+	}
+	ac.match([]byte("ushers"), func(patternIndex, end int) {
+		got = append(got, struct {
+			pattern string
+			end     int
+		}{string(ac.patterns[patternIndex]), end})
+	})
+
+	want := map[string]bool{"she": true, "he": true, "hers": true}
+	if len(got) != len(want) {
+		t.Fatalf("got %v matches, want %d", got, len(want))
+	}
+	for _, g := range got {
+		if !want[g.pattern] {
+			t.Errorf("unexpected match %q at %d", g.pattern, g.end)
+		}
+	}
+}
+
+func TestAhoCorasickMatcherCaseInsensitive(t *testing.T) {
+	m := newAhoCorasickMatcher([]string{"Foo"}, false)
+	lm, err := m.Match([]byte("no match here\nfound a foo right here\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lm) != 1 || lm[0].LineNumber != 2 {
+		t.Fatalf("got %+v, want one match on line 2", lm)
+	}
+}
+
+func TestAhoCorasickMatcherMultiPattern(t *testing.T) {
+	m := newAhoCorasickMatcher([]string{"foo", "bar"}, true)
+	lm, err := m.Match([]byte("foo only\nbar only\nfoo and bar together\nneither\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lm) != 3 {
+		t.Fatalf("got %d line matches, want 3: %+v", len(lm), lm)
+	}
+	if len(lm[2].OffsetAndLengths) != 2 {
+		t.Errorf("line 3 should report both the foo and bar hits, got %+v", lm[2].OffsetAndLengths)
+	}
+}
+
+// repeatLine builds roughly n bytes of repeated source-like content.
+func repeatLine(n int) []byte {
+	const line = "package main\nfunc doSomething() { return }\n"
+	content := make([]byte, 0, n+len(line))
+	for len(content) < n {
+		content = append(content, line...)
+	}
+	return content
+}
+
+func BenchmarkAhoCorasickMatcherSinglePattern(b *testing.B) {
+	content := repeatLine(64 * 1024)
+	m := newAhoCorasickMatcher([]string{"doSomething"}, true)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.Match(content); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAhoCorasickMatcherManyPatterns(b *testing.B) {
+	content := repeatLine(64 * 1024)
+	patterns := []string{"doSomething", "package", "func", "return", "main", "TODO", "FIXME", "error"}
+	m := newAhoCorasickMatcher(patterns, true)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.Match(content); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package search
+
+import "strings"
+
+// languageExtensions maps a language identifier (as used by Query.Lang) to
+// the file extensions considered to be that language. Keep this small and
+// extend it as new languages need filtering.
+var languageExtensions = map[string][]string{
+	"go":         {".go"},
+	"typescript": {".ts", ".tsx"},
+	"javascript": {".js", ".jsx"},
+	"python":     {".py"},
+	"java":       {".java"},
+	"ruby":       {".rb"},
+	"c":          {".c", ".h"},
+	"cpp":        {".cpp", ".cc", ".cxx", ".hpp"},
+}
+
+// matchesLang reports whether path's extension belongs to lang. An
+// unrecognized lang matches nothing, rather than matching everything.
+func matchesLang(lang, path string) bool {
+	for _, ext := range languageExtensions[strings.ToLower(lang)] {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// languageForFile returns the language path's extension belongs to, or ""
+// if it isn't recognized.
+func languageForFile(path string) string {
+	for lang, exts := range languageExtensions {
+		for _, ext := range exts {
+			if strings.HasSuffix(path, ext) {
+				return lang
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,36 @@
+package search
+
+import "testing"
+
+func TestMatchesLang(t *testing.T) {
+	cases := []struct {
+		lang, path string
+		want       bool
+	}{
+		{"go", "cmd/searcher/search/query.go", true},
+		{"Go", "cmd/searcher/search/query.go", true}, // case-insensitive lang
+		{"python", "cmd/searcher/search/query.go", false},
+		{"made-up-lang", "main.go", false},
+	}
+	for _, c := range cases {
+		if got := matchesLang(c.lang, c.path); got != c.want {
+			t.Errorf("matchesLang(%q, %q) = %v, want %v", c.lang, c.path, got, c.want)
+		}
+	}
+}
+
+func TestLanguageForFile(t *testing.T) {
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"main.go", "go"},
+		{"app.tsx", "typescript"},
+		{"README.md", ""},
+	}
+	for _, c := range cases {
+		if got := languageForFile(c.path); got != c.want {
+			t.Errorf("languageForFile(%q) = %q, want %q", c.path, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package search
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+)
+
+// Matcher is a pluggable search backend: given a file's full content, it
+// returns the line matches found, or nil if there were none. Promoting
+// this to an interface (rather than always compiling one *regexp.Regexp
+// per request) lets fixed-string and multi-pattern queries run through an
+// engine built for them instead of the general regexp one.
+type Matcher interface {
+	Match(content []byte) ([]LineMatch, error)
+}
+
+// newMatcher builds the Matcher backend for a single pattern.
+func newMatcher(pattern string, isRegExp, isWordMatch, caseSensitive bool) (Matcher, error) {
+	return newPatternsMatcher([]string{pattern}, isRegExp, isWordMatch, caseSensitive)
+}
+
+// newPatternsMatcher is like newMatcher, but for a batch of patterns
+// searched together (see Params.Patterns): a single Aho-Corasick
+// automaton is built once and every file is streamed through it in one
+// pass, rather than once per pattern.
+//
+// Fixed strings that don't need word-boundary handling always go through
+// the Aho-Corasick engine (aho_corasick.go), including the single-pattern
+// case. Anything that needs real regex semantics falls back to
+// regexpMatcher, with a required-literal prefilter so most files are
+// ruled out by one bytes.Contains before the regexp engine ever runs.
+// Multiple patterns can't share a regexpMatcher, so a batch of more than
+// one pattern is rejected unless all of them are fixed strings.
+func newPatternsMatcher(patterns []string, isRegExp, isWordMatch, caseSensitive bool) (Matcher, error) {
+	for _, p := range patterns {
+		if p == "" {
+			return nil, fmt.Errorf("pattern must not be empty")
+		}
+	}
+
+	if !isRegExp && !isWordMatch {
+		return newAhoCorasickMatcher(patterns, caseSensitive), nil
+	}
+	if len(patterns) != 1 {
+		return nil, fmt.Errorf("multiple patterns are only supported as fixed strings")
+	}
+
+	re, err := compilePattern(patterns[0], isRegExp, isWordMatch, caseSensitive)
+	if err != nil {
+		return nil, err
+	}
+	return newRegexpMatcher(re, literalPrefilter(patterns[0], isRegExp, caseSensitive)), nil
+}
+
+// regexpMatcher is the original, fully general matcher backend: it runs
+// re over every line. If prefilter is set, a file is skipped entirely
+// unless it contains prefilter, a substring every match of re is
+// guaranteed to contain.
+type regexpMatcher struct {
+	re        *regexp.Regexp
+	prefilter []byte
+}
+
+func newRegexpMatcher(re *regexp.Regexp, prefilter []byte) *regexpMatcher {
+	return &regexpMatcher{re: re, prefilter: prefilter}
+}
+
+func (m *regexpMatcher) Match(content []byte) ([]LineMatch, error) {
+	if m.prefilter != nil && !bytes.Contains(content, m.prefilter) {
+		return nil, nil
+	}
+
+	var matches []LineMatch
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Bytes()
+		locs := m.re.FindAllIndex(line, -1)
+		if locs == nil {
+			continue
+		}
+		offsetAndLengths := make([][2]int, len(locs))
+		for i, loc := range locs {
+			offsetAndLengths[i] = [2]int{loc[0], loc[1] - loc[0]}
+		}
+		matches = append(matches, LineMatch{
+			Preview:          string(line),
+			LineNumber:       lineNumber,
+			OffsetAndLengths: offsetAndLengths,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// compilePattern turns a pattern and its match options into a single
+// *regexp.Regexp, quoting it first if it is a fixed string rather than a
+// regular expression. It is the one place a pattern is turned into a
+// regexp, shared by the flat Params form and the structured Query leaves.
+func compilePattern(pattern string, isRegExp, isWordMatch, isCaseSensitive bool) (*regexp.Regexp, error) {
+	expr := pattern
+	if !isRegExp {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if isWordMatch {
+		expr = `\b` + expr + `\b`
+	}
+
+	flags := syntax.Perl
+	if !isCaseSensitive {
+		flags |= syntax.FoldCase
+	}
+	parsed, err := syntax.Parse(expr, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	return regexp.Compile(parsed.String())
+}
+
+// literalPrefilter returns the longest literal substring every match of
+// pattern is guaranteed to contain, or nil if none can be proven (eg a
+// regular expression has no mandatory literal, or its longest one is too
+// short to be worth a bytes.Contains pass over the whole file first). A
+// fixed string is returned as is, whatever its length.
+//
+// Only attempted for case-sensitive patterns: a correct case-insensitive
+// bytes.Contains would need folding the haystack first, which costs more
+// than the prefilter saves.
+func literalPrefilter(pattern string, isRegExp, caseSensitive bool) []byte {
+	if !caseSensitive {
+		return nil
+	}
+	if !isRegExp {
+		return []byte(pattern)
+	}
+
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	lit := longestLiteral(re.Simplify())
+	if len(lit) < 3 {
+		return nil
+	}
+	return lit
+}
+
+// longestLiteral returns the longest run of literal text re is guaranteed
+// to match, recursing into captures and merging adjacent literals across
+// concatenation boundaries. Case-folded literals (eg under "(?i)") don't
+// count, since a match needn't contain them byte for byte.
+func longestLiteral(re *syntax.Regexp) []byte {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil
+		}
+		return []byte(string(re.Rune))
+	case syntax.OpCapture:
+		return longestLiteral(re.Sub[0])
+	case syntax.OpConcat:
+		var best, run []byte
+		flush := func() {
+			if len(run) > len(best) {
+				best = run
+			}
+			run = nil
+		}
+		for _, sub := range re.Sub {
+			if sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == 0 {
+				run = append(run, []byte(string(sub.Rune))...)
+				continue
+			}
+			flush()
+		}
+		flush()
+		return best
+	default:
+		return nil
+	}
+}
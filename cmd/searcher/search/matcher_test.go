@@ -0,0 +1,20 @@
+package search
+
+import "testing"
+
+// TestNewPatternsMatcherRejectsEmptyPattern reproduces an empty string in
+// Patterns landing on the Aho-Corasick root state, whose output is then hit
+// on every step: without this check, newAhoCorasickMatcher([]string{""},
+// true).Match(...) returns a zero-length match at every byte offset of
+// every file searched.
+func TestNewPatternsMatcherRejectsEmptyPattern(t *testing.T) {
+	if _, err := newPatternsMatcher([]string{"foo", ""}, false, false, true); err == nil {
+		t.Fatal("expected an error for an empty pattern, got nil")
+	}
+}
+
+func TestNewMatcherRejectsEmptyPattern(t *testing.T) {
+	if _, err := newMatcher("", false, false, true); err == nil {
+		t.Fatal("expected an error for an empty pattern, got nil")
+	}
+}
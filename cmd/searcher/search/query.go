@@ -0,0 +1,543 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Query is a composite search query, decoded from a POST /search JSON
+// body. It mirrors Zoekt's REST query language: exactly one of the boolean
+// operators (And, Or, Not) or leaf fields (Substr, Regexp, Patterns, File,
+// Lang, Repo+Commit, Symbol) should be set per node.
+//
+//	{"and": [{"repo": "...", "commit": "..."}, {"substr": "foo"}]}
+//	{"or": [{"substr": "foo"}, {"substr": "bar"}]}
+//	{"not": {"file": "vendor/**"}}
+type Query struct {
+	And []*Query `json:"and,omitempty"`
+	Or  []*Query `json:"or,omitempty"`
+	Not *Query   `json:"not,omitempty"`
+
+	// Substr matches a fixed string.
+	Substr string `json:"substr,omitempty"`
+	// CaseSensitive applies to Substr, Regexp, Patterns, and Symbol.
+	CaseSensitive bool `json:"caseSensitive,omitempty"`
+	// Regexp matches a regular expression.
+	Regexp string `json:"regexp,omitempty"`
+
+	// Patterns matches any one of a batch of fixed strings, all searched
+	// for in a single pass via one Aho-Corasick automaton rather than N
+	// separate scans.
+	Patterns []string `json:"patterns,omitempty"`
+
+	// File restricts matching to files whose path matches this glob (see
+	// path.Match).
+	File string `json:"file,omitempty"`
+	// Lang restricts matching to files belonging to this language (eg
+	// "go", "typescript").
+	Lang string `json:"lang,omitempty"`
+
+	// Repo and Commit together select which archive to search. Every
+	// query must contain exactly one leaf that sets them.
+	Repo   string `json:"repo,omitempty"`
+	Commit string `json:"commit,omitempty"`
+
+	// Symbol matches files where the pattern matches a detected symbol
+	// name, rather than anywhere in the file.
+	Symbol string `json:"symbol,omitempty"`
+}
+
+// kindCount returns how many of q's mutually exclusive fields are set. A
+// valid node has exactly one.
+func (q *Query) kindCount() int {
+	n := 0
+	if len(q.And) > 0 {
+		n++
+	}
+	if len(q.Or) > 0 {
+		n++
+	}
+	if q.Not != nil {
+		n++
+	}
+	if q.Substr != "" {
+		n++
+	}
+	if q.Regexp != "" {
+		n++
+	}
+	if len(q.Patterns) > 0 {
+		n++
+	}
+	if q.File != "" {
+		n++
+	}
+	if q.Lang != "" {
+		n++
+	}
+	if q.Repo != "" || q.Commit != "" {
+		n++
+	}
+	if q.Symbol != "" {
+		n++
+	}
+	return n
+}
+
+// paramsToQuery translates the flat Params form into the equivalent Query,
+// so the GET form-encoded endpoint can run through the same compile and
+// search path as POST /search.
+func paramsToQuery(p *Params) *Query {
+	var leaf *Query
+	switch {
+	case len(p.Patterns) > 0:
+		leaf = &Query{Patterns: p.Patterns, CaseSensitive: p.IsCaseSensitive}
+	case p.IsSymbol:
+		leaf = &Query{Symbol: p.Pattern, CaseSensitive: p.IsCaseSensitive}
+	case p.IsRegExp || p.IsWordMatch:
+		expr := p.Pattern
+		if !p.IsRegExp {
+			expr = regexp.QuoteMeta(expr)
+		}
+		if p.IsWordMatch {
+			expr = `\b` + expr + `\b`
+		}
+		leaf = &Query{Regexp: expr, CaseSensitive: p.IsCaseSensitive}
+	default:
+		leaf = &Query{Substr: p.Pattern, CaseSensitive: p.IsCaseSensitive}
+	}
+
+	and := []*Query{
+		{Repo: p.Repo, Commit: p.Commit},
+		leaf,
+	}
+	if p.Lang != "" {
+		and = append(and, &Query{Lang: p.Lang})
+	}
+	return &Query{And: and}
+}
+
+// compileQuery validates and compiles q, returning the (repo, commit) it
+// targets and a queryNode tree to evaluate against each file in that
+// archive.
+func compileQuery(q *Query) (repo, commit string, root queryNode, err error) {
+	root, err = compileNode(q, &repo, &commit)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if repo == "" || commit == "" {
+		return "", "", nil, fmt.Errorf("query must contain exactly one {repo, commit} leaf")
+	}
+	return repo, commit, root, nil
+}
+
+func compileNode(q *Query, repo, commit *string) (queryNode, error) {
+	if q == nil {
+		return nil, fmt.Errorf("empty query node")
+	}
+	if n := q.kindCount(); n != 1 {
+		return nil, fmt.Errorf("query node must set exactly one of and/or/not/substr/regexp/patterns/file/lang/repo/symbol, got %d", n)
+	}
+
+	switch {
+	case len(q.And) > 0:
+		return compileBoolNode(q.And, repo, commit, true)
+	case len(q.Or) > 0:
+		return compileBoolNode(q.Or, repo, commit, false)
+	case q.Not != nil:
+		sub, err := compileNode(q.Not, repo, commit)
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{sub}, nil
+	case q.Repo != "" || q.Commit != "":
+		if q.Repo == "" || q.Commit == "" {
+			return nil, fmt.Errorf("repo and commit must both be set")
+		}
+		if *repo != "" {
+			return nil, fmt.Errorf("query may only contain one {repo, commit} leaf")
+		}
+		if err := validateCommit(q.Commit); err != nil {
+			return nil, err
+		}
+		*repo, *commit = q.Repo, q.Commit
+		return trueNode{}, nil
+	case q.File != "":
+		return &fileNode{pattern: q.File}, nil
+	case q.Lang != "":
+		return &langNode{lang: q.Lang}, nil
+	case q.Substr != "":
+		return newContentNode(q.Substr, false, q.CaseSensitive)
+	case q.Regexp != "":
+		return newContentNode(q.Regexp, true, q.CaseSensitive)
+	case len(q.Patterns) > 0:
+		return newPatternsNode(q.Patterns, q.CaseSensitive)
+	case q.Symbol != "":
+		return newSymbolNode(q.Symbol, q.CaseSensitive), nil
+	default:
+		return nil, fmt.Errorf("empty query node")
+	}
+}
+
+func compileBoolNode(subs []*Query, repo, commit *string, and bool) (queryNode, error) {
+	nodes := make([]queryNode, len(subs))
+	for i, sub := range subs {
+		n, err := compileNode(sub, repo, commit)
+		if err != nil {
+			return nil, err
+		}
+		nodes[i] = n
+	}
+	if and {
+		return &andNode{nodes}, nil
+	}
+	return &orNode{nodes}, nil
+}
+
+// queryNode is a compiled, evaluable node of a Query tree.
+type queryNode interface {
+	// provablyFalse reports whether the node can already be determined to
+	// be false using only the file's path, without opening it. Used to
+	// skip zip entries before they're read. It must never report true for
+	// a file that could actually match (no false "provably false"s).
+	provablyFalse(path string) bool
+
+	// eval evaluates the node against an already-read file, returning
+	// whether it matched and the line matches (if any) it produced.
+	eval(path string, content []byte) (matched bool, lineMatches []LineMatch, err error)
+
+	// trigramQuery returns a conservative trigram prefilter for the node,
+	// or nil if it doesn't constrain file content (eg a pure path filter,
+	// or a branch of an Or that itself has no trigram constraint).
+	trigramQuery() *trigramQuery
+}
+
+// trueNode always matches and never constrains anything; it's what a
+// {repo, commit} leaf compiles to, since selecting the archive to search
+// already satisfies it.
+type trueNode struct{}
+
+func (trueNode) provablyFalse(string) bool                      { return false }
+func (trueNode) eval(string, []byte) (bool, []LineMatch, error) { return true, nil, nil }
+func (trueNode) trigramQuery() *trigramQuery                    { return nil }
+
+// fileNode matches files whose path matches a glob. A "**" path segment is
+// special-cased to match zero or more whole path segments (eg "vendor/**"
+// matches "vendor/foo/bar.go", not just direct children of vendor/); every
+// other segment is matched with path.Match, which does not cross "/".
+type fileNode struct{ pattern string }
+
+func (n *fileNode) matches(p string) bool {
+	return matchGlob(strings.Split(n.pattern, "/"), strings.Split(p, "/"))
+}
+func (n *fileNode) provablyFalse(p string) bool { return !n.matches(p) }
+func (n *fileNode) eval(p string, _ []byte) (bool, []LineMatch, error) {
+	return n.matches(p), nil, nil
+}
+func (n *fileNode) trigramQuery() *trigramQuery { return nil }
+
+// matchGlob reports whether nameSegs is matched by patSegs, the "/"
+// -separated segments of a fileNode pattern and a path respectively.
+func matchGlob(patSegs, nameSegs []string) bool {
+	if len(patSegs) == 0 {
+		return len(nameSegs) == 0
+	}
+	if patSegs[0] == "**" {
+		if matchGlob(patSegs[1:], nameSegs) {
+			return true
+		}
+		return len(nameSegs) > 0 && matchGlob(patSegs, nameSegs[1:])
+	}
+	if len(nameSegs) == 0 {
+		return false
+	}
+	ok, err := path.Match(patSegs[0], nameSegs[0])
+	return err == nil && ok && matchGlob(patSegs[1:], nameSegs[1:])
+}
+
+// langNode matches files belonging to a language.
+type langNode struct{ lang string }
+
+func (n *langNode) provablyFalse(p string) bool { return !matchesLang(n.lang, p) }
+func (n *langNode) eval(p string, _ []byte) (bool, []LineMatch, error) {
+	return matchesLang(n.lang, p), nil, nil
+}
+func (n *langNode) trigramQuery() *trigramQuery { return nil }
+
+// contentNode matches files containing a pattern, reporting the matching
+// lines.
+type contentNode struct {
+	m  Matcher
+	tq *trigramQuery
+}
+
+func newContentNode(pattern string, isRegExp, caseSensitive bool) (*contentNode, error) {
+	m, err := newMatcher(pattern, isRegExp, false, caseSensitive)
+	if err != nil {
+		return nil, err
+	}
+	tq, err := trigramQueryForPattern(pattern, isRegExp)
+	if err != nil {
+		return nil, err
+	}
+	return &contentNode{m: m, tq: tq}, nil
+}
+
+func (n *contentNode) provablyFalse(string) bool { return false }
+func (n *contentNode) eval(_ string, content []byte) (bool, []LineMatch, error) {
+	lm, err := n.m.Match(content)
+	if err != nil {
+		return false, nil, err
+	}
+	return lm != nil, lm, nil
+}
+func (n *contentNode) trigramQuery() *trigramQuery { return n.tq }
+
+// patternsNode matches files containing any one of a batch of fixed
+// strings, all searched for in a single pass via a shared Aho-Corasick
+// automaton (see Query.Patterns).
+type patternsNode struct {
+	m  Matcher
+	tq *trigramQuery
+}
+
+func newPatternsNode(patterns []string, caseSensitive bool) (*patternsNode, error) {
+	m, err := newPatternsMatcher(patterns, false, false, caseSensitive)
+	if err != nil {
+		return nil, err
+	}
+	q := &trigramQuery{op: trigramOr}
+	for _, p := range patterns {
+		q.subs = append(q.subs, stringTrigramQuery(p))
+	}
+	return &patternsNode{m: m, tq: q}, nil
+}
+
+func (n *patternsNode) provablyFalse(string) bool { return false }
+func (n *patternsNode) eval(_ string, content []byte) (bool, []LineMatch, error) {
+	lm, err := n.m.Match(content)
+	if err != nil {
+		return false, nil, err
+	}
+	return lm != nil, lm, nil
+}
+func (n *patternsNode) trigramQuery() *trigramQuery { return n.tq }
+
+// andNode matches if every sub-node matches.
+type andNode struct{ subs []queryNode }
+
+func (n *andNode) provablyFalse(p string) bool {
+	for _, sub := range n.subs {
+		if sub.provablyFalse(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *andNode) eval(p string, content []byte) (bool, []LineMatch, error) {
+	var matches []LineMatch
+	for _, sub := range n.subs {
+		ok, lm, err := sub.eval(p, content)
+		if err != nil {
+			return false, nil, err
+		}
+		if !ok {
+			return false, nil, nil
+		}
+		matches = append(matches, lm...)
+	}
+	return true, matches, nil
+}
+
+func (n *andNode) trigramQuery() *trigramQuery {
+	q := &trigramQuery{op: trigramAnd}
+	for _, sub := range n.subs {
+		if tq := sub.trigramQuery(); tq != nil {
+			q.subs = append(q.subs, tq)
+		}
+	}
+	if len(q.subs) == 0 {
+		return nil
+	}
+	return q
+}
+
+// orNode matches if any sub-node matches.
+type orNode struct{ subs []queryNode }
+
+func (n *orNode) provablyFalse(p string) bool {
+	for _, sub := range n.subs {
+		if !sub.provablyFalse(p) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *orNode) eval(p string, content []byte) (bool, []LineMatch, error) {
+	matched := false
+	var matches []LineMatch
+	for _, sub := range n.subs {
+		ok, lm, err := sub.eval(p, content)
+		if err != nil {
+			return false, nil, err
+		}
+		if ok {
+			matched = true
+			matches = append(matches, lm...)
+		}
+	}
+	return matched, matches, nil
+}
+
+func (n *orNode) trigramQuery() *trigramQuery {
+	q := &trigramQuery{op: trigramOr}
+	for _, sub := range n.subs {
+		tq := sub.trigramQuery()
+		if tq == nil {
+			// An unconstrained branch means a file could match the Or
+			// purely through it, so the whole node can't rule anything out.
+			return nil
+		}
+		q.subs = append(q.subs, tq)
+	}
+	return q
+}
+
+// notNode matches if its sub-node doesn't. It can't be used to skip files
+// by path (the sub-node not matching the content is not knowable from the
+// path alone) or to prefilter by trigram (a required absence doesn't
+// correspond to a required trigram).
+type notNode struct{ sub queryNode }
+
+func (n *notNode) provablyFalse(string) bool { return false }
+func (n *notNode) eval(p string, content []byte) (bool, []LineMatch, error) {
+	ok, _, err := n.sub.eval(p, content)
+	if err != nil {
+		return false, nil, err
+	}
+	return !ok, nil, nil
+}
+func (n *notNode) trigramQuery() *trigramQuery { return nil }
+
+// Stats summarizes a search's execution, so callers can drive pagination
+// and ranking.
+type Stats struct {
+	FilesSearched int
+	FilesSkipped  int
+	MatchCount    int
+	Duration      time.Duration
+}
+
+// Response is the result of a POST /search structured query.
+type Response struct {
+	Matches []FileMatch
+	Stats   Stats
+}
+
+// serveQuery handles the structured POST /search query API.
+func (s *Service) serveQuery(w http.ResponseWriter, r *http.Request) {
+	var q Query
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		http.Error(w, "failed to decode query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	repo, commit, root, err := compileQuery(&q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	matches, stats, err := s.searchQuery(r.Context(), repo, commit, root)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if isBadRequest(err) {
+			code = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if matches == nil {
+		matches = make([]FileMatch, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(Response{Matches: matches, Stats: stats}); err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// searchQuery runs root against repo at commit, using the trigram index to
+// shrink the candidate set and root.provablyFalse to skip files by path
+// before they're even opened.
+func (s *Service) searchQuery(ctx context.Context, repo, commit string, root queryNode) ([]FileMatch, Stats, error) {
+	start := time.Now()
+
+	r, closer, err := s.openReader(ctx, repo, commit)
+	if err != nil {
+		return nil, Stats{}, err
+	}
+	defer closer.Close()
+
+	idx, err := s.trigramIndex(commit, r)
+	if err != nil {
+		return nil, Stats{}, err
+	}
+	candidates := idx.candidateFileIDs(root.trigramQuery())
+
+	var stats Stats
+	var matches []FileMatch
+	evalFile := func(fileID int) error {
+		f := r.File[fileID]
+		if root.provablyFalse(f.Name) {
+			stats.FilesSkipped++
+			return nil
+		}
+
+		content, err := readZipEntry(closer, f)
+		if err != nil {
+			return err
+		}
+		if isLikelyBinary(content) {
+			stats.FilesSkipped++
+			return nil
+		}
+		stats.FilesSearched++
+
+		ok, lm, err := root.eval(f.Name, content)
+		if err != nil {
+			return err
+		}
+		if ok {
+			matches = append(matches, FileMatch{Path: f.Name, LineMatches: lm})
+			stats.MatchCount += len(lm)
+		}
+		return nil
+	}
+
+	if candidates == nil {
+		for fileID := range r.File {
+			if err := evalFile(fileID); err != nil {
+				return nil, Stats{}, err
+			}
+		}
+	} else {
+		stats.FilesSkipped += len(r.File) - len(candidates)
+		for _, fileID := range candidates {
+			if err := evalFile(int(fileID)); err != nil {
+				return nil, Stats{}, err
+			}
+		}
+	}
+
+	stats.Duration = time.Since(start)
+	return matches, stats, nil
+}
@@ -0,0 +1,139 @@
+package search
+
+import "testing"
+
+func TestFileNodeMatchesDoubleStar(t *testing.T) {
+	n := &fileNode{pattern: "vendor/**"}
+
+	cases := []struct {
+		path string
+		want bool
+	}{
+		{"vendor/foo.go", true},
+		{"vendor/foo/bar.go", true},
+		{"vendor/foo/bar/baz.go", true},
+		{"other/foo.go", false},
+		{"vendormodule/foo.go", false},
+	}
+	for _, c := range cases {
+		if got := n.matches(c.path); got != c.want {
+			t.Errorf("matches(%q) = %v, want %v", c.path, got, c.want)
+		}
+	}
+}
+
+func TestFileNodeMatchesSingleStarStaysWithinSegment(t *testing.T) {
+	n := &fileNode{pattern: "*.go"}
+	if n.matches("pkg/foo.go") {
+		t.Error("*.go should not match across a path separator")
+	}
+	if !n.matches("foo.go") {
+		t.Error("*.go should match a top-level file")
+	}
+}
+
+const testCommit = "cccccccccccccccccccccccccccccccccccccccc"
+
+func TestCompileQueryRequiresExactlyOneRepoCommitLeaf(t *testing.T) {
+	_, _, _, err := compileQuery(&Query{Substr: "foo"})
+	if err == nil {
+		t.Fatal("expected an error when no {repo, commit} leaf is present")
+	}
+
+	q := &Query{And: []*Query{
+		{Repo: "r1", Commit: testCommit},
+		{Repo: "r2", Commit: testCommit},
+		{Substr: "foo"},
+	}}
+	if _, _, _, err := compileQuery(q); err == nil {
+		t.Fatal("expected an error for more than one {repo, commit} leaf")
+	}
+}
+
+func TestCompileQueryRejectsMalformedCommit(t *testing.T) {
+	for _, commit := range []string{"a", "../../../../etc/passwd", "DEADBEEFDEADBEEFDEADBEEFDEADBEEFDEADBEEF"} {
+		q := &Query{And: []*Query{
+			{Repo: "r", Commit: commit},
+			{Substr: "foo"},
+		}}
+		if _, _, _, err := compileQuery(q); err == nil {
+			t.Errorf("compileQuery(commit=%q) should have been rejected", commit)
+		} else if !isBadRequest(err) {
+			t.Errorf("compileQuery(commit=%q) error should be a bad request, got %v", commit, err)
+		}
+	}
+}
+
+func TestCompileQueryAndOrNot(t *testing.T) {
+	q := &Query{And: []*Query{
+		{Repo: "r", Commit: testCommit},
+		{Or: []*Query{{Substr: "foo"}, {Substr: "bar"}}},
+		{Not: &Query{File: "vendor/**"}},
+	}}
+	repo, commit, root, err := compileQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo != "r" || commit != testCommit {
+		t.Fatalf("got repo=%q commit=%q", repo, commit)
+	}
+
+	ok, _, err := root.eval("main.go", []byte("foo\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("expected main.go containing foo to match")
+	}
+
+	ok, _, err = root.eval("vendor/pkg/main.go", []byte("foo\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("expected a vendored file to be excluded by the Not{File} branch")
+	}
+}
+
+func TestCompileQueryRejectsAmbiguousNode(t *testing.T) {
+	q := &Query{
+		Repo: "r", Commit: testCommit,
+	}
+	q.Substr = "foo"
+	q.Regexp = "bar"
+	if _, _, _, err := compileQuery(q); err == nil {
+		t.Fatal("expected an error when a node sets more than one of its mutually exclusive fields")
+	}
+}
+
+func TestCompileQueryPatternsLeaf(t *testing.T) {
+	q := &Query{And: []*Query{
+		{Repo: "r", Commit: testCommit},
+		{Patterns: []string{"foo", "bar"}},
+	}}
+	_, _, root, err := compileQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, _, err := root.eval("f.go", []byte("contains bar here\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("expected a Patterns leaf to match any one of its patterns")
+	}
+}
+
+func TestParamsToQueryRoundTrips(t *testing.T) {
+	p := &Params{Repo: "r", Commit: testCommit, Pattern: "foo", Lang: "go"}
+	repo, commit, root, err := compileQuery(paramsToQuery(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo != "r" || commit != testCommit {
+		t.Fatalf("got repo=%q commit=%q", repo, commit)
+	}
+	if !root.provablyFalse("main.py") {
+		t.Error("expected the Lang leaf to rule out a non-Go file by path alone")
+	}
+}
@@ -13,31 +13,67 @@ package search
 
 import (
 	"archive/zip"
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/gorilla/schema"
 )
 
 // ArchiveStore is how the service gets the content to search.
 type ArchiveStore interface {
-	// FetchZip returns a []byte to a zip archive. If the error implements
+	// FetchZip returns a reader for the zip archive of repo at commit. The
+	// caller must Close it once done. If the error implements
 	// "BadRequest() bool", it will be used to determine if the error is a
 	// bad request (eg invalid repo).
-	//
-	// NOTE: gitcmd.Open.Archive returns the bytes in memory. However, we
-	// only need to be able to stream it in. Update to io.ReadCloser once
-	// we have a nice way to stream in the archive.
-	FetchZip(ctx context.Context, repo, commit string) ([]byte, error)
+	FetchZip(ctx context.Context, repo, commit string) (io.ReadCloser, error)
 }
 
 // Service is the search service. It is an http.Handler.
 type Service struct {
 	ArchiveStore ArchiveStore
+
+	// CacheDir is the directory fetched archives are cached in on disk. If
+	// empty, a directory under os.TempDir is used.
+	CacheDir string
+
+	// MaxCacheSizeBytes is the on-disk archive cache high-water mark above
+	// which least-recently-used archives are evicted. 0 means unbounded.
+	MaxCacheSizeBytes int64
+
+	// trigramIndexes caches the trigram index built for a commit, keyed by
+	// commit SHA. Since a commit's contents are immutable, entries never
+	// need to be invalidated, only evicted: archiveStore wires the
+	// underlying Store's OnEvict so an index never outlives the on-disk
+	// archive it was built from.
+	trigramIndexes sync.Map // commit string -> *trigramIndex
+
+	storeOnce sync.Once
+	store     *Store
+}
+
+// archiveStore lazily builds the disk-backed, single-flighted Store that
+// wraps s.ArchiveStore.
+func (s *Service) archiveStore() *Store {
+	s.storeOnce.Do(func() {
+		cacheDir := s.CacheDir
+		if cacheDir == "" {
+			cacheDir = filepath.Join(os.TempDir(), "searcher-archives")
+		}
+		s.store = &Store{
+			ArchiveStore:      s.ArchiveStore,
+			CacheDir:          cacheDir,
+			MaxCacheSizeBytes: s.MaxCacheSizeBytes,
+			OnEvict:           func(commit string) { s.trigramIndexes.Delete(commit) },
+		}
+	})
+	return s.store
 }
 
 var decoder = schema.NewDecoder()
@@ -61,10 +97,20 @@ type Params struct {
 	// IsCaseSensitive if false will ignore the case of text and pattern
 	// when finding matches.
 	IsCaseSensitive bool
+	// Lang, if non-empty, restricts the search to files belonging to this
+	// language (eg "go", "typescript"), skipped before they're even opened.
+	Lang string
+	// IsSymbol if true will treat Pattern as the name of a symbol to find
+	// the definition of, rather than a string to find anywhere in a file.
+	IsSymbol bool
+	// Patterns, if non-empty, searches for any one of a batch of fixed
+	// strings in a single pass, instead of Pattern. Mutually exclusive with
+	// Pattern.
+	Patterns []string
 }
 
 func (p Params) String() string {
-	opts := make([]byte, 1, 4)
+	opts := make([]byte, 1, 5)
 	opts[0] = ' '
 	if p.IsRegExp {
 		opts = append(opts, 'r')
@@ -75,6 +121,9 @@ func (p Params) String() string {
 	if p.IsCaseSensitive {
 		opts = append(opts, 'c')
 	}
+	if p.IsSymbol {
+		opts = append(opts, 's')
+	}
 	var optsS string
 	if len(opts) > 1 {
 		optsS = string(opts)
@@ -93,12 +142,24 @@ type FileMatch struct {
 type LineMatch struct {
 	Preview    string
 	LineNumber int
-	// TODO vscode also wants to know the range of matches on the line.
-	// OffsetAndLengths [][2]int
+	// OffsetAndLengths is the set of [offset, length] pairs (byte offsets
+	// into Preview) of each match on the line.
+	OffsetAndLengths [][2]int
+	// SymbolKind is set when this match came from a symbol search (eg
+	// "func", "class", "type"), and empty otherwise.
+	SymbolKind string `json:",omitempty"`
 }
 
-// ServeHTTP handles HTTP based search requests
+// ServeHTTP handles HTTP based search requests. A POST is treated as a
+// structured Query (see query.go); anything else falls back to the
+// original flat, form-encoded Params, translated into the same Query
+// machinery under the hood.
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		s.serveQuery(w, r)
+		return
+	}
+
 	err := r.ParseForm()
 	if err != nil {
 		http.Error(w, "failed to parse form: "+err.Error(), http.StatusBadRequest)
@@ -139,52 +200,53 @@ func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// search runs p by translating it into a Query and delegating to the same
+// pipeline serveQuery uses, discarding the Stats to keep this endpoint's
+// response shape backward compatible.
 func (s *Service) search(ctx context.Context, p *Params) ([]FileMatch, error) {
-	// TODO use platinum searcher or sift to search
-	// TODO pretty aggressively skip files to search
-
-	matcher, err := compile(p)
+	repo, commit, root, err := compileQuery(paramsToQuery(p))
 	if err != nil {
 		return nil, badRequestError{err.Error()}
 	}
+	matches, _, err := s.searchQuery(ctx, repo, commit, root)
+	return matches, err
+}
 
-	r, err := s.openReader(ctx, p.Repo, p.Commit)
-	if err != nil {
-		return nil, err
+// trigramIndex returns the trigram index for commit, building it on first
+// use. r must be the zip.Reader for the same commit. Three tiers are
+// checked in order, cheapest first: the in-memory cache, the
+// on-disk persisted index (see trigram_persist.go), and finally building
+// from r itself, which also persists the result for next time.
+func (s *Service) trigramIndex(commit string, r *zip.Reader) (*trigramIndex, error) {
+	if cached, ok := s.trigramIndexes.Load(commit); ok {
+		return cached.(*trigramIndex), nil
 	}
 
-	var matches []FileMatch
-	for _, f := range r.File {
-		rc, err := f.Open()
-		if err != nil {
-			return nil, err
-		}
-		lm, err := matcher(rc)
-		rc.Close()
-		if err != nil {
-			return nil, err
-		}
-		if lm != nil {
-			matches = append(matches, FileMatch{
-				Path:        f.Name, // TODO name likely needs to be changed
-				LineMatches: lm,
-			})
-		}
+	indexPath := s.archiveStore().indexPath(commit)
+	if idx, err := loadTrigramIndex(indexPath); err == nil {
+		actual, _ := s.trigramIndexes.LoadOrStore(commit, idx)
+		return actual.(*trigramIndex), nil
 	}
-	return matches, nil
-}
 
-// openReader will open a zip reader to the
-func (s *Service) openReader(ctx context.Context, repo, commit string) (*zip.Reader, error) {
-	// TODO single-flight
-	// TODO disk backed with cache eviction
-	// TODO rewrite zip on disk to be more efficient to access (prune files, etc)
-	b, err := s.ArchiveStore.FetchZip(ctx, repo, commit)
+	idx, err := buildTrigramIndex(r)
 	if err != nil {
 		return nil, err
 	}
-	rAt := bytes.NewReader(b)
-	return zip.NewReader(rAt, int64(len(b)))
+	// Best-effort: a failure to persist just means this commit rebuilds
+	// its index from the archive again next time, same as today.
+	_ = persistTrigramIndex(indexPath, idx)
+
+	actual, _ := s.trigramIndexes.LoadOrStore(commit, idx)
+	return actual.(*trigramIndex), nil
+}
+
+// openReader opens a zip reader for repo at commit, via the disk-backed
+// archive cache. The returned io.Closer must be closed once the caller is
+// done with the *zip.Reader.
+//
+// TODO rewrite zip on disk to be more efficient to access (prune files, etc)
+func (s *Service) openReader(ctx context.Context, repo, commit string) (*zip.Reader, io.Closer, error) {
+	return s.archiveStore().zipReader(ctx, repo, commit)
 }
 
 func validateParams(p *Params) error {
@@ -195,9 +257,17 @@ func validateParams(p *Params) error {
 	if len(p.Commit) != 40 {
 		return fmt.Errorf("Commit must be resolved (Commit=%q)", p.Commit)
 	}
-	if p.Pattern == "" {
+	if p.Pattern == "" && len(p.Patterns) == 0 {
 		return errors.New("Pattern must be non-empty")
 	}
+	if p.Pattern != "" && len(p.Patterns) > 0 {
+		return errors.New("Pattern and Patterns are mutually exclusive")
+	}
+	for _, pat := range p.Patterns {
+		if pat == "" {
+			return errors.New("Patterns must not contain an empty string")
+		}
+	}
 	return nil
 }
 
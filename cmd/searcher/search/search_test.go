@@ -0,0 +1,139 @@
+package search
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestServeHTTPQueryEndToEnd exercises the full POST /search pipeline -
+// compile query, fetch archive, trigram prefilter, path filter, matcher,
+// stats - through ServeHTTP, rather than any one stage in isolation.
+func TestServeHTTPQueryEndToEnd(t *testing.T) {
+	zipData := makeTestZip(t, "the quick brown fox\njumps over the lazy dog\n")
+	s := &Service{
+		ArchiveStore: &fakeArchiveStore{data: zipData},
+		CacheDir:     t.TempDir(),
+	}
+
+	body, err := json.Marshal(&Query{And: []*Query{
+		{Repo: "r", Commit: testCommit},
+		{Substr: "lazy dog"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/search", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	var resp Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to decode response: %v (body %q)", err, rec.Body.String())
+	}
+	if len(resp.Matches) != 1 || resp.Matches[0].Path != "a.txt" {
+		t.Fatalf("got matches %+v, want a single match on a.txt", resp.Matches)
+	}
+	if resp.Stats.FilesSearched != 1 {
+		t.Errorf("got FilesSearched=%d, want 1", resp.Stats.FilesSearched)
+	}
+	if resp.Stats.MatchCount == 0 {
+		t.Error("expected at least one line match")
+	}
+}
+
+// TestServiceReusesPersistedTrigramIndexAcrossRestart reproduces a process
+// restart that lands on the same CacheDir: a fresh Service with an empty
+// in-memory trigramIndexes must still skip rebuilding the index from the
+// archive, since the first Service already persisted it to disk.
+func TestServiceReusesPersistedTrigramIndexAcrossRestart(t *testing.T) {
+	cacheDir := t.TempDir()
+	const commit = "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef"
+	zipData := makeTestZip(t, "package foo\nfunc Foo() {}\n")
+
+	first := &Service{ArchiveStore: &fakeArchiveStore{data: zipData}, CacheDir: cacheDir}
+	r, closer, err := first.openReader(context.Background(), "repo", commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.trigramIndex(commit, r); err != nil {
+		t.Fatal(err)
+	}
+	closer.Close()
+
+	archiveStore := &fakeArchiveStore{data: zipData}
+	second := &Service{ArchiveStore: archiveStore, CacheDir: cacheDir}
+	_, closer, err = second.openReader(context.Background(), "repo", commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	// Hand trigramIndex an empty archive: rebuilding from it would give an
+	// index with no files, so only loading the persisted one yields a.txt.
+	idx, err := second.trigramIndex(commit, &zip.Reader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.files) != 1 || idx.files[0] != "a.txt" {
+		t.Errorf("got index files %v, want the persisted [a.txt]", idx.files)
+	}
+
+	// The archive is already in the shared CacheDir from the first
+	// Service, so the second one doesn't fetch it again either.
+	if got := archiveStore.calls; got != 0 {
+		t.Errorf("ArchiveStore.FetchZip called %d times, want 0", got)
+	}
+	if _, ok := second.trigramIndexes.Load(commit); !ok {
+		t.Error("expected the persisted index to be loaded into the fresh Service's in-memory cache")
+	}
+}
+
+// TestServiceEvictsTrigramIndexWithArchive reproduces an unbounded
+// trigramIndexes cache: once a commit's on-disk archive is evicted by the
+// Store's LRU, its in-memory trigram index must go with it, not live
+// forever in Service.trigramIndexes.
+func TestServiceEvictsTrigramIndexWithArchive(t *testing.T) {
+	s := &Service{
+		ArchiveStore:      &fakeArchiveStore{data: makeTestZip(t, "large archive contents")},
+		CacheDir:          t.TempDir(),
+		MaxCacheSizeBytes: 1, // evict everything but the archive just fetched
+	}
+
+	const commitA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	const commitB = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	r, closer, err := s.openReader(context.Background(), "repo", commitA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.trigramIndex(commitA, r); err != nil {
+		t.Fatal(err)
+	}
+	closer.Close()
+
+	if _, ok := s.trigramIndexes.Load(commitA); !ok {
+		t.Fatal("expected commitA's trigram index to be cached")
+	}
+
+	// Fetching a second commit pushes the cache over its size limit,
+	// evicting commitA's archive (and, now, its trigram index).
+	r, closer, err = s.openReader(context.Background(), "repo", commitB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closer.Close()
+	_ = r
+
+	if _, ok := s.trigramIndexes.Load(commitA); ok {
+		t.Error("commitA's trigram index should have been evicted along with its archive")
+	}
+}
@@ -0,0 +1,231 @@
+package search
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// commitRE matches a fully-resolved git commit SHA: exactly what Store.path
+// builds a filesystem path out of. Enforced once, here, rather than trusted
+// from a caller: a commit shorter than 2 bytes would panic on commit[:2],
+// and anything containing "/" or ".." could otherwise write outside
+// CacheDir.
+var commitRE = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+func validateCommit(commit string) error {
+	if !commitRE.MatchString(commit) {
+		return badRequestError{fmt.Sprintf("commit must be a 40-character lowercase hex string, got %q", commit)}
+	}
+	return nil
+}
+
+// Store turns an ArchiveStore into a memory-stable one by caching fetched
+// archives on disk, keyed by commit SHA. Since a commit SHA is immutable
+// and only resolves to one set of file contents, multiple repos that
+// happen to share a commit (eg both forked from the same point) safely
+// share the same cache entry.
+//
+// It replaces the TODOs that used to live on openReader: concurrent
+// requests for the same (repo, commit) are single-flighted into one
+// gitserver fetch, the result is written to disk instead of held in
+// memory, and the disk cache is bounded by evicting least-recently-used
+// entries once it grows past MaxCacheSizeBytes.
+type Store struct {
+	// ArchiveStore is the underlying source of archives, eg gitserver.
+	ArchiveStore ArchiveStore
+
+	// CacheDir is the directory fetched archives are cached in.
+	CacheDir string
+
+	// MaxCacheSizeBytes is the high-water mark of total cache size above
+	// which least-recently-used archives are evicted. 0 means unbounded.
+	MaxCacheSizeBytes int64
+
+	// OnEvict, if set, is called with the commit SHA of every archive
+	// evict removes from disk, so a cache keyed off the same commit (eg
+	// Service.trigramIndexes) can be kept from outliving the archive it
+	// was built from.
+	OnEvict func(commit string)
+
+	fetch singleflight.Group
+}
+
+// zipReader returns a *zip.Reader for repo at commit, fetching and caching
+// the archive on disk first if necessary. The returned io.Closer must be
+// closed once the caller is done with the reader.
+func (s *Store) zipReader(ctx context.Context, repo, commit string) (*zip.Reader, io.Closer, error) {
+	if err := validateCommit(commit); err != nil {
+		return nil, nil, err
+	}
+	path := s.path(repo, commit)
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if _, err, _ := s.fetch.Do(path, func() (interface{}, error) {
+			// A flight for path may have finished between the Stat above
+			// and this Do; don't fetch the archive a second time.
+			if _, err := os.Stat(path); err == nil {
+				return nil, nil
+			}
+			return nil, s.fetchToDisk(ctx, repo, commit, path)
+		}); err != nil {
+			return nil, nil, err
+		}
+		touch(path)
+		s.evict(path)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	touch(path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	r, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return r, f, nil
+}
+
+// fetchToDisk fetches repo at commit from the underlying ArchiveStore and
+// streams it straight to path, without ever holding the whole archive in
+// memory. It writes to a temp file first and renames into place so a
+// reader can never observe a partially-written archive.
+func (s *Store) fetchToDisk(ctx context.Context, repo, commit, path string) error {
+	rc, err := s.ArchiveStore.FetchZip(ctx, repo, commit)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".tmp-archive-")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // no-op once the rename below succeeds
+
+	_, copyErr := io.Copy(tmp, rc)
+	closeErr := tmp.Close()
+	if copyErr != nil {
+		return copyErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// path returns the on-disk, content-addressed path for (repo, commit).
+func (s *Store) path(repo, commit string) string {
+	// Fan out like git's own object store so a single directory doesn't
+	// end up with one entry per commit ever fetched.
+	return filepath.Join(s.CacheDir, commit[:2], commit+".zip")
+}
+
+// indexPath returns the on-disk path for commit's persisted trigram index
+// (see trigram_persist.go), alongside its cached zip archive.
+func (s *Store) indexPath(commit string) string {
+	return filepath.Join(s.CacheDir, commit[:2], commit+".trigrams")
+}
+
+// touch bumps path's mtime to now so it is treated as recently used by
+// evict. Best-effort: if it fails the entry just looks falsely old, which
+// only risks evicting it a little early.
+func touch(path string) {
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+}
+
+// evict removes least-recently-used cached archives until the store's
+// total on-disk size is back under MaxCacheSizeBytes. keep is never
+// removed, even if it is the oldest (or only) entry and alone exceeds
+// MaxCacheSizeBytes: it is the archive the caller just fetched and is
+// about to open, and evicting it out from under that open would turn
+// any single archive larger than the cache limit into a permanent,
+// un-cacheable miss on every request. Best-effort: errors stating or
+// removing an individual entry just skip that entry.
+func (s *Store) evict(keep string) {
+	if s.MaxCacheSizeBytes <= 0 {
+		return
+	}
+
+	// A commit's persisted trigram index (trigram_persist.go) lives next
+	// to its zip and must be evicted with it: leaving it behind would
+	// both leak disk space this accounting doesn't know about and let a
+	// stale index outlive the archive it was checked out of.
+	indexPathFor := func(zipPath string) string {
+		return strings.TrimSuffix(zipPath, ".zip") + ".trigrams"
+	}
+
+	type entry struct {
+		path    string
+		size    int64 // zip plus its sibling trigram index, if any
+		modTime time.Time
+	}
+	var entries []entry
+	var total int64
+	_ = filepath.Walk(s.CacheDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || filepath.Ext(path) != ".zip" {
+			return nil
+		}
+		size := fi.Size()
+		if ifi, err := os.Stat(indexPathFor(path)); err == nil {
+			size += ifi.Size()
+		}
+		entries = append(entries, entry{path: path, size: size, modTime: fi.ModTime()})
+		total += size
+		return nil
+	})
+	if total <= s.MaxCacheSizeBytes {
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	for _, e := range entries {
+		if total <= s.MaxCacheSizeBytes {
+			break
+		}
+		if e.path == keep {
+			continue
+		}
+		if os.Remove(e.path) == nil {
+			total -= e.size
+			os.Remove(indexPathFor(e.path)) // best-effort, may never have been persisted
+			if s.OnEvict != nil {
+				s.OnEvict(commitFromPath(e.path))
+			}
+		}
+	}
+}
+
+// commitFromPath recovers the commit SHA a cache path was written under
+// (see Store.path).
+func commitFromPath(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".zip")
+}
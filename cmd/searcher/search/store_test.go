@@ -0,0 +1,136 @@
+package search
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeArchiveStore serves a fixed payload for every FetchZip call, counting
+// how many times it was actually invoked.
+type fakeArchiveStore struct {
+	data  []byte
+	calls int32
+}
+
+func (f *fakeArchiveStore) FetchZip(context.Context, string, string) (io.ReadCloser, error) {
+	atomic.AddInt32(&f.calls, 1)
+	return ioutil.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+func makeTestZip(t *testing.T, contents string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestStoreZipReaderLargerThanCacheSize reproduces a large archive evicting
+// itself: if MaxCacheSizeBytes is smaller than the archive just fetched,
+// evict must not delete the entry zipReader is about to open.
+func TestStoreZipReaderLargerThanCacheSize(t *testing.T) {
+	dir := t.TempDir()
+	payload := makeTestZip(t, "this archive is bigger than the configured cache size")
+	archiveStore := &fakeArchiveStore{data: payload}
+	s := &Store{
+		ArchiveStore:      archiveStore,
+		CacheDir:          dir,
+		MaxCacheSizeBytes: 1, // far smaller than payload
+	}
+
+	const commit = "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef"
+
+	_, closer, err := s.zipReader(context.Background(), "repo", commit)
+	if err != nil {
+		t.Fatalf("zipReader returned error: %v", err)
+	}
+	closer.Close()
+
+	// A second fetch must be a cache hit, not another gitserver round trip
+	// caused by the first entry having evicted itself.
+	_, closer, err = s.zipReader(context.Background(), "repo", commit)
+	if err != nil {
+		t.Fatalf("second zipReader returned error: %v", err)
+	}
+	closer.Close()
+	if got := atomic.LoadInt32(&archiveStore.calls); got != 1 {
+		t.Errorf("ArchiveStore.FetchZip called %d times, want exactly 1", got)
+	}
+}
+
+// TestStoreZipReaderRejectsMalformedCommit reproduces a panic (commit
+// shorter than 2 bytes indexed by Store.path) and a path-traversal write
+// outside CacheDir (a commit containing "/.."), both from an unvalidated
+// commit reaching Store.path.
+func TestStoreZipReaderRejectsMalformedCommit(t *testing.T) {
+	s := &Store{
+		ArchiveStore: &fakeArchiveStore{data: makeTestZip(t, "x")},
+		CacheDir:     t.TempDir(),
+	}
+
+	for _, commit := range []string{
+		"",
+		"a",
+		"../../../../etc/passwd",
+		"deadbeefdeadbeefdeadbeefdeadbeefdeadbee/../x",
+		"DEADBEEFDEADBEEFDEADBEEFDEADBEEFDEADBEEF", // uppercase hex, wrong case
+		"deadbeefdeadbeefdeadbeefdeadbeefdeadbee",  // 39 chars, one short
+	} {
+		if _, _, err := s.zipReader(context.Background(), "repo", commit); err == nil {
+			t.Errorf("zipReader(commit=%q) should have been rejected", commit)
+		} else if !isBadRequest(err) {
+			t.Errorf("zipReader(commit=%q) error should be a bad request, got %v", commit, err)
+		}
+	}
+}
+
+// TestStoreZipReaderSingleFlightsConcurrentFetches fires N simultaneous
+// zipReader calls for the same (repo, commit) and asserts the underlying
+// ArchiveStore is only actually fetched from once.
+func TestStoreZipReaderSingleFlightsConcurrentFetches(t *testing.T) {
+	archiveStore := &fakeArchiveStore{data: makeTestZip(t, "shared archive")}
+	s := &Store{
+		ArchiveStore: archiveStore,
+		CacheDir:     t.TempDir(),
+	}
+
+	const commit = "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef"
+	const n = 20
+
+	start := make(chan struct{})
+	done := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			<-start
+			_, closer, err := s.zipReader(context.Background(), "repo", commit)
+			if closer != nil {
+				closer.Close()
+			}
+			done <- err
+		}()
+	}
+	close(start)
+	for i := 0; i < n; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("zipReader returned error: %v", err)
+		}
+	}
+
+	if got := atomic.LoadInt32(&archiveStore.calls); got != 1 {
+		t.Errorf("ArchiveStore.FetchZip called %d times, want exactly 1", got)
+	}
+}
@@ -0,0 +1,138 @@
+package search
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// This file implements a lightweight, ctags-style symbol extractor: a set
+// of per-language regexes that recognize common definition forms (func,
+// class, def, type, ...). It's not a real parser and will miss and
+// misdetect plenty of definitions; it exists so IsSymbol / a symbol Query
+// leaf can answer "find definition of X" without standing up a separate
+// indexer.
+
+// symbolPattern finds one kind of symbol definition within a single
+// language. The first submatch of re is the symbol's name.
+type symbolPattern struct {
+	kind string
+	re   *regexp.Regexp
+}
+
+var symbolPatternsByLang = map[string][]symbolPattern{
+	"go": {
+		{kind: "func", re: regexp.MustCompile(`^\s*func\s+(?:\([^)]*\)\s*)?(\w+)`)},
+		{kind: "type", re: regexp.MustCompile(`^\s*type\s+(\w+)`)},
+	},
+	"python": {
+		{kind: "def", re: regexp.MustCompile(`^\s*def\s+(\w+)`)},
+		{kind: "class", re: regexp.MustCompile(`^\s*class\s+(\w+)`)},
+	},
+	"typescript": {
+		{kind: "function", re: regexp.MustCompile(`^\s*(?:export\s+)?function\s+(\w+)`)},
+		{kind: "class", re: regexp.MustCompile(`^\s*(?:export\s+)?class\s+(\w+)`)},
+	},
+	"javascript": {
+		{kind: "function", re: regexp.MustCompile(`^\s*(?:export\s+)?function\s+(\w+)`)},
+		{kind: "class", re: regexp.MustCompile(`^\s*(?:export\s+)?class\s+(\w+)`)},
+	},
+	"java": {
+		{kind: "class", re: regexp.MustCompile(`^\s*(?:public|private|protected)?\s*class\s+(\w+)`)},
+	},
+	"ruby": {
+		{kind: "def", re: regexp.MustCompile(`^\s*def\s+(\w+)`)},
+		{kind: "class", re: regexp.MustCompile(`^\s*class\s+(\w+)`)},
+	},
+}
+
+// allSymbolPatterns is every pattern across every language, used as a
+// fallback when a file's language isn't recognized.
+var allSymbolPatterns []symbolPattern
+
+func init() {
+	for _, patterns := range symbolPatternsByLang {
+		allSymbolPatterns = append(allSymbolPatterns, patterns...)
+	}
+}
+
+// symbolOccurrence is one symbol definition found on a line.
+type symbolOccurrence struct {
+	kind string
+	name string
+}
+
+// symbolsInLine returns the symbols defined on line. If lang isn't
+// recognized, every known pattern is tried rather than none.
+func symbolsInLine(lang string, line []byte) []symbolOccurrence {
+	patterns, ok := symbolPatternsByLang[lang]
+	if !ok {
+		patterns = allSymbolPatterns
+	}
+
+	var occs []symbolOccurrence
+	for _, p := range patterns {
+		if m := p.re.FindSubmatch(line); m != nil {
+			occs = append(occs, symbolOccurrence{kind: p.kind, name: string(m[1])})
+		}
+	}
+	return occs
+}
+
+// symbolNode matches files containing a definition of a symbol named
+// pattern, reporting the defining line annotated with the symbol's kind.
+type symbolNode struct {
+	pattern       string
+	caseSensitive bool
+}
+
+func newSymbolNode(pattern string, caseSensitive bool) *symbolNode {
+	return &symbolNode{pattern: pattern, caseSensitive: caseSensitive}
+}
+
+func (n *symbolNode) matchesName(name string) bool {
+	if n.caseSensitive {
+		return name == n.pattern
+	}
+	return strings.EqualFold(name, n.pattern)
+}
+
+func (n *symbolNode) provablyFalse(string) bool { return false }
+
+func (n *symbolNode) eval(path string, content []byte) (bool, []LineMatch, error) {
+	lang := languageForFile(path)
+
+	var matches []LineMatch
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Bytes()
+		for _, occ := range symbolsInLine(lang, line) {
+			if !n.matchesName(occ.name) {
+				continue
+			}
+			var offsetAndLengths [][2]int
+			if idx := bytes.Index(line, []byte(occ.name)); idx >= 0 {
+				offsetAndLengths = [][2]int{{idx, len(occ.name)}}
+			}
+			matches = append(matches, LineMatch{
+				Preview:          string(line),
+				LineNumber:       lineNumber,
+				OffsetAndLengths: offsetAndLengths,
+				SymbolKind:       occ.kind,
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, nil, err
+	}
+	return matches != nil, matches, nil
+}
+
+// trigramQuery requires the symbol's name to appear literally somewhere in
+// the file, since any defining line contains it as plain text.
+func (n *symbolNode) trigramQuery() *trigramQuery {
+	return stringTrigramQuery(n.pattern)
+}
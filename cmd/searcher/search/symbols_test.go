@@ -0,0 +1,66 @@
+package search
+
+import "testing"
+
+func TestSymbolsInLine(t *testing.T) {
+	cases := []struct {
+		lang string
+		line string
+		want symbolOccurrence
+	}{
+		{"go", "func DoSomething(x int) error {", symbolOccurrence{kind: "func", name: "DoSomething"}},
+		{"go", "type Store struct {", symbolOccurrence{kind: "type", name: "Store"}},
+		{"python", "def handle_request(req):", symbolOccurrence{kind: "def", name: "handle_request"}},
+		{"typescript", "export class Widget {", symbolOccurrence{kind: "class", name: "Widget"}},
+	}
+	for _, c := range cases {
+		occs := symbolsInLine(c.lang, []byte(c.line))
+		if len(occs) != 1 || occs[0] != c.want {
+			t.Errorf("symbolsInLine(%q, %q) = %v, want [%v]", c.lang, c.line, occs, c.want)
+		}
+	}
+}
+
+func TestSymbolsInLineNoMatch(t *testing.T) {
+	if occs := symbolsInLine("go", []byte("x := 1")); occs != nil {
+		t.Errorf("expected no symbols, got %v", occs)
+	}
+}
+
+func TestSymbolNodeEval(t *testing.T) {
+	n := newSymbolNode("DoSomething", true)
+	content := []byte("package foo\n\nfunc DoSomething() {\n\treturn\n}\n")
+
+	ok, lm, err := n.eval("foo.go", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || len(lm) != 1 {
+		t.Fatalf("got ok=%v lm=%v, want a single match", ok, lm)
+	}
+	if lm[0].SymbolKind != "func" || lm[0].LineNumber != 3 {
+		t.Errorf("got %+v, want kind=func line=3", lm[0])
+	}
+}
+
+func TestSymbolNodeEvalCaseInsensitive(t *testing.T) {
+	n := newSymbolNode("dosomething", false)
+	ok, _, err := n.eval("foo.go", []byte("func DoSomething() {}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("expected a case-insensitive symbol match")
+	}
+}
+
+func TestSymbolNodeEvalNoMatch(t *testing.T) {
+	n := newSymbolNode("NotThere", true)
+	ok, lm, err := n.eval("foo.go", []byte("func DoSomething() {}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || lm != nil {
+		t.Errorf("got ok=%v lm=%v, want no match", ok, lm)
+	}
+}
@@ -0,0 +1,343 @@
+package search
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"regexp/syntax"
+)
+
+// This file implements an in-memory trigram index over the files of a
+// single (repo, commit) archive, modeled after Zoekt. Instead of
+// `.Open()`ing and scanning every file in the zip, search() can decompose
+// the query into a trigramQuery, intersect/union the posting lists in the
+// index, and run the real matcher only on the resulting candidate files.
+//
+// Indexes are cached in memory (Service.trigramIndexes) and persisted to
+// disk next to the cached zip (see trigram_persist.go, Store.indexPath),
+// keyed by the same commit SHA the archive cache (store.go) uses. Both
+// copies are evicted together with the archive, so a commit whose archive
+// is still on disk but whose in-memory index is gone (eg after a process
+// restart) rebuilds the in-memory copy by reading the persisted file
+// instead of rescanning the zip; a
+// commit evicted entirely (or never indexed on this node before) rebuilds
+// from scratch and persists the result for next time.
+
+// trigram is a 3-byte sequence packed into the low 24 bits of a uint32.
+type trigram uint32
+
+func newTrigram(b0, b1, b2 byte) trigram {
+	return trigram(b0)<<16 | trigram(b1)<<8 | trigram(b2)
+}
+
+// trigramsOf returns the set of distinct trigrams present in data.
+func trigramsOf(data []byte) map[trigram]struct{} {
+	if len(data) < 3 {
+		return nil
+	}
+	trigrams := make(map[trigram]struct{}, len(data))
+	t := newTrigram(data[0], data[1], data[2])
+	trigrams[t] = struct{}{}
+	for i := 3; i < len(data); i++ {
+		t = ((t << 8) | trigram(data[i])) & 0xffffff
+		trigrams[t] = struct{}{}
+	}
+	return trigrams
+}
+
+// isLikelyBinary reports whether data looks like binary content. It uses
+// the same null-byte-in-the-first-few-hundred-bytes heuristic as git and
+// most other text search tools.
+func isLikelyBinary(data []byte) bool {
+	if len(data) > 256 {
+		data = data[:256]
+	}
+	for _, b := range data {
+		if b == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// trigramIndex is a per-archive trigram index: it maps a trigram to the
+// sorted list of file IDs whose content contains it, so a trigramQuery can
+// be evaluated by intersecting/unioning posting lists instead of opening
+// every file.
+type trigramIndex struct {
+	// files are the indexed file names, by file ID (index into the
+	// zip.Reader's File slice).
+	files []string
+
+	// postings maps a trigram, folded to lowercase, to the sorted file IDs
+	// containing it. Folding case at index time means a case-insensitive
+	// query is a single lookup instead of a union over every case variant;
+	// callers that need exact case still verify with the real matcher.
+	postings map[trigram][]int32
+
+	// alwaysScan are file IDs that were not indexed (too small to contain a
+	// trigram, or skipped as binary) and so must always be scanned
+	// directly, regardless of what the trigramQuery says.
+	alwaysScan []int32
+}
+
+// buildTrigramIndex indexes every file in r.
+func buildTrigramIndex(r *zip.Reader) (*trigramIndex, error) {
+	idx := &trigramIndex{
+		files:    make([]string, len(r.File)),
+		postings: make(map[trigram][]int32),
+	}
+
+	for fileID, f := range r.File {
+		idx.files[fileID] = f.Name
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(data) < 3 || isLikelyBinary(data) {
+			idx.alwaysScan = append(idx.alwaysScan, int32(fileID))
+			continue
+		}
+
+		for t := range trigramsOf(bytesToLower(data)) {
+			idx.postings[t] = append(idx.postings[t], int32(fileID))
+		}
+	}
+
+	return idx, nil
+}
+
+// candidateFileIDs evaluates q against idx and returns the sorted, deduped
+// file IDs that might contain a match, plus any un-indexed files that must
+// always be scanned. It returns nil if every file needs to be scanned (idx
+// or q is nil, or q can't rule anything out).
+func (idx *trigramIndex) candidateFileIDs(q *trigramQuery) []int32 {
+	if idx == nil || q == nil {
+		return nil
+	}
+	ids, all := idx.eval(q)
+	if all {
+		return nil
+	}
+	candidates := mergeSorted(ids, idx.alwaysScan)
+	if candidates == nil {
+		// No candidates at all, which is not the same as "scan everything".
+		candidates = []int32{}
+	}
+	return candidates
+}
+
+// eval returns the sorted file IDs matching q, and all=true if q doesn't
+// rule out any file (eg it reduced to trigramAll).
+func (idx *trigramIndex) eval(q *trigramQuery) (ids []int32, all bool) {
+	switch q.op {
+	case trigramAtom:
+		return idx.postings[q.trigram], false
+	case trigramAnd:
+		have := false
+		for _, sub := range q.subs {
+			subIDs, subAll := idx.eval(sub)
+			if subAll {
+				continue
+			}
+			if !have {
+				ids, have = subIDs, true
+				continue
+			}
+			ids = intersectSorted(ids, subIDs)
+		}
+		return ids, !have
+	case trigramOr:
+		for _, sub := range q.subs {
+			subIDs, subAll := idx.eval(sub)
+			if subAll {
+				return nil, true
+			}
+			ids = unionSorted(ids, subIDs)
+		}
+		return ids, false
+	default: // trigramAll
+		return nil, true
+	}
+}
+
+// trigramOp is the kind of node in a trigramQuery tree.
+type trigramOp int
+
+const (
+	// trigramAll matches every file; used whenever we can't prove a
+	// particular substring is required to be present (eg "a*", ".", an
+	// alternation with an empty-matching branch).
+	trigramAll trigramOp = iota
+	trigramAtom
+	trigramAnd
+	trigramOr
+)
+
+// trigramQuery is a boolean expression over trigrams that is guaranteed to
+// match every file a regexp could match, used to shrink the candidate set
+// before running the real matcher. Since it may also match files the
+// regexp doesn't (false positives), it must never be pickier than the
+// regexp itself (no false negatives).
+type trigramQuery struct {
+	op      trigramOp
+	trigram trigram         // set when op == trigramAtom
+	subs    []*trigramQuery // set when op is trigramAnd/trigramOr
+}
+
+func allTrigramQuery() *trigramQuery { return &trigramQuery{op: trigramAll} }
+
+// trigramQueryForPattern returns the trigramQuery implied by pattern. Case
+// is always folded (see trigramIndex.postings), so this is correct
+// regardless of whether the eventual match is case-sensitive.
+func trigramQueryForPattern(pattern string, isRegExp bool) (*trigramQuery, error) {
+	if !isRegExp {
+		return stringTrigramQuery(pattern), nil
+	}
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	return regexpTrigramQuery(re.Simplify()), nil
+}
+
+// regexpTrigramQuery analyzes re and returns the trigramQuery implied by
+// it. Anything it can't reason about (repetition, char classes, anchors,
+// ...) degrades to trigramAll rather than risk a false negative.
+func regexpTrigramQuery(re *syntax.Regexp) *trigramQuery {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return stringTrigramQuery(string(re.Rune))
+	case syntax.OpCapture:
+		return regexpTrigramQuery(re.Sub[0])
+	case syntax.OpConcat:
+		return concatTrigramQuery(re.Sub)
+	case syntax.OpAlternate:
+		q := &trigramQuery{op: trigramOr}
+		for _, sub := range re.Sub {
+			q.subs = append(q.subs, regexpTrigramQuery(sub))
+		}
+		return q
+	default:
+		// OpStar, OpPlus, OpQuest, OpCharClass, OpAnyChar(NotNL), anchors,
+		// etc: none of these guarantee a fixed substring is present.
+		return allTrigramQuery()
+	}
+}
+
+// concatTrigramQuery handles an OpConcat's children, merging adjacent
+// literal runs so trigrams spanning a concatenation boundary (eg "oba" in
+// "foo"+"bar") aren't missed.
+func concatTrigramQuery(subs []*syntax.Regexp) *trigramQuery {
+	and := &trigramQuery{op: trigramAnd}
+	var lit []rune
+	flush := func() {
+		if len(lit) > 0 {
+			and.subs = append(and.subs, stringTrigramQuery(string(lit)))
+			lit = nil
+		}
+	}
+	for _, sub := range subs {
+		if sub.Op == syntax.OpLiteral {
+			lit = append(lit, sub.Rune...)
+			continue
+		}
+		flush()
+		and.subs = append(and.subs, regexpTrigramQuery(sub))
+	}
+	flush()
+	return and
+}
+
+// stringTrigramQuery returns the AND of every trigram in s, folded to
+// lowercase with bytesToLower to match how the index was built. Trigrams
+// containing a non-ASCII byte are left out: bytesToLower doesn't fold
+// them, so a case-insensitive match may differ from s in exactly those
+// bytes. Strings shorter than a trigram can't rule anything out.
+func stringTrigramQuery(s string) *trigramQuery {
+	data := bytesToLower([]byte(s))
+	if len(data) < 3 {
+		return allTrigramQuery()
+	}
+	and := &trigramQuery{op: trigramAnd}
+	for t := range trigramsOf(data) {
+		if t&0x808080 != 0 {
+			continue
+		}
+		and.subs = append(and.subs, &trigramQuery{op: trigramAtom, trigram: t})
+	}
+	return and
+}
+
+// bytesToLower is like bytes.ToLower but avoids the unicode-aware case
+// folding overhead of strings.ToLower for plain ASCII source files, which
+// make up the overwhelming majority of what's indexed.
+func bytesToLower(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		if b >= 'A' && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		out[i] = b
+	}
+	return out
+}
+
+// --- sorted int32 slice set operations ---
+
+func intersectSorted(a, b []int32) []int32 {
+	var out []int32
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, a[i])
+			i++
+			j++
+		case a[i] < b[j]:
+			i++
+		default:
+			j++
+		}
+	}
+	return out
+}
+
+func unionSorted(a, b []int32) []int32 {
+	return mergeSorted(a, b)
+}
+
+// mergeSorted merges two sorted, deduped slices into one sorted, deduped
+// slice.
+func mergeSorted(a, b []int32) []int32 {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	out := make([]int32, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, a[i])
+			i++
+			j++
+		case a[i] < b[j]:
+			out = append(out, a[i])
+			i++
+		default:
+			out = append(out, b[j])
+			j++
+		}
+	}
+	out = append(out, a[i:]...)
+	out = append(out, b[j:]...)
+	return out
+}
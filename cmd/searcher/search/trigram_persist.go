@@ -0,0 +1,195 @@
+package search
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// trigramIndexMagic tags the start of a persisted trigram index, so a file
+// left over from an incompatible version of this format is rejected
+// instead of misread as garbage.
+const trigramIndexMagic = "srchtrig1"
+
+// writeTrigramIndex encodes idx as a stream of varints. Posting lists (and
+// alwaysScan) are delta-encoded: their file IDs are already sorted
+// ascending, so the deltas are small and usually fit a single byte each.
+func writeTrigramIndex(w io.Writer, idx *trigramIndex) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(trigramIndexMagic); err != nil {
+		return err
+	}
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(v uint64) error {
+		n := binary.PutUvarint(buf, v)
+		_, err := bw.Write(buf[:n])
+		return err
+	}
+	putIDs := func(ids []int32) error {
+		if err := putUvarint(uint64(len(ids))); err != nil {
+			return err
+		}
+		var prev int32
+		for _, id := range ids {
+			if err := putUvarint(uint64(id - prev)); err != nil {
+				return err
+			}
+			prev = id
+		}
+		return nil
+	}
+
+	if err := putUvarint(uint64(len(idx.files))); err != nil {
+		return err
+	}
+	for _, name := range idx.files {
+		if err := putUvarint(uint64(len(name))); err != nil {
+			return err
+		}
+		if _, err := bw.WriteString(name); err != nil {
+			return err
+		}
+	}
+
+	if err := putIDs(idx.alwaysScan); err != nil {
+		return err
+	}
+
+	if err := putUvarint(uint64(len(idx.postings))); err != nil {
+		return err
+	}
+	for t, ids := range idx.postings {
+		if err := putUvarint(uint64(t)); err != nil {
+			return err
+		}
+		if err := putIDs(ids); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// readTrigramIndex decodes an index written by writeTrigramIndex.
+func readTrigramIndex(r io.Reader) (*trigramIndex, error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(trigramIndexMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != trigramIndexMagic {
+		return nil, fmt.Errorf("trigram index: unrecognized format %q", magic)
+	}
+
+	getIDs := func() ([]int32, error) {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, nil
+		}
+		ids := make([]int32, n)
+		var prev int32
+		for i := range ids {
+			delta, err := binary.ReadUvarint(br)
+			if err != nil {
+				return nil, err
+			}
+			prev += int32(delta)
+			ids[i] = prev
+		}
+		return ids, nil
+	}
+
+	nFiles, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	idx := &trigramIndex{
+		files:    make([]string, nFiles),
+		postings: make(map[trigram][]int32, nFiles),
+	}
+	for i := range idx.files {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return nil, err
+		}
+		idx.files[i] = string(name)
+	}
+
+	if idx.alwaysScan, err = getIDs(); err != nil {
+		return nil, err
+	}
+
+	nTrigrams, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < nTrigrams; i++ {
+		tv, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		ids, err := getIDs()
+		if err != nil {
+			return nil, err
+		}
+		idx.postings[trigram(tv)] = ids
+	}
+
+	return idx, nil
+}
+
+// persistTrigramIndex writes idx to path, via a temp file renamed into
+// place so a concurrent loadTrigramIndex can never observe a partial
+// write. Best-effort: callers treat a failure here the same as never
+// having persisted at all, since the index can always be rebuilt from
+// the archive.
+func persistTrigramIndex(path string, idx *trigramIndex) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".tmp-trigrams-")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // no-op once the rename below succeeds
+
+	writeErr := writeTrigramIndex(tmp, idx)
+	closeErr := tmp.Close()
+	if writeErr != nil {
+		return writeErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// loadTrigramIndex reads an index previously written by
+// persistTrigramIndex. Callers should treat any error, including one
+// because path doesn't exist, as a cache miss and fall back to rebuilding
+// from the archive.
+func loadTrigramIndex(path string) (*trigramIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readTrigramIndex(f)
+}
@@ -0,0 +1,216 @@
+package search
+
+import (
+	"archive/zip"
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"regexp/syntax"
+	"testing"
+)
+
+func buildIndex(t *testing.T, files map[string]string) *trigramIndex {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, contents := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := buildTrigramIndex(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+func candidateNames(idx *trigramIndex, q *trigramQuery) []string {
+	ids := idx.candidateFileIDs(q)
+	if ids == nil {
+		names := make([]string, len(idx.files))
+		copy(names, idx.files)
+		return names
+	}
+	var names []string
+	for _, id := range ids {
+		names = append(names, idx.files[id])
+	}
+	return names
+}
+
+func TestTrigramIndexAndOrAll(t *testing.T) {
+	idx := buildIndex(t, map[string]string{
+		"a.go": "package foo\nfunc Foo() {}\n",
+		"b.go": "package bar\nfunc Bar() {}\n",
+		"c.go": "package foo\nfunc Bar() {}\n",
+	})
+
+	// AND of two literal queries: only c.go has both "foo" and "Bar".
+	and := &trigramQuery{op: trigramAnd, subs: []*trigramQuery{
+		stringTrigramQuery("foo"),
+		stringTrigramQuery("Bar"),
+	}}
+	got := candidateNames(idx, and)
+	if !reflect.DeepEqual(got, []string{"c.go"}) {
+		t.Errorf("AND: got %v, want [c.go]", got)
+	}
+
+	// OR of two literal queries: every file has one or the other.
+	or := &trigramQuery{op: trigramOr, subs: []*trigramQuery{
+		stringTrigramQuery("foo"),
+		stringTrigramQuery("Bar"),
+	}}
+	got = candidateNames(idx, or)
+	if len(got) != 3 {
+		t.Errorf("OR: got %v, want all 3 files", got)
+	}
+
+	// A query that degrades to trigramAll must not rule out any file.
+	if ids := idx.candidateFileIDs(allTrigramQuery()); ids != nil {
+		t.Errorf("trigramAll query should return nil (scan everything), got %v", ids)
+	}
+}
+
+func parseTrigramQuery(t *testing.T, pattern string) *trigramQuery {
+	t.Helper()
+	q, err := trigramQueryForPattern(pattern, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestRegexpTrigramQueryAlternate(t *testing.T) {
+	// An alternation only guarantees a match came from one branch or the
+	// other, so the implied query must be an OR, not an AND: a file
+	// matching only "bar" must still be a candidate.
+	idx := buildIndex(t, map[string]string{
+		"a.go": "package foo\n",
+		"b.go": "package bar\n",
+		"c.go": "package baz\n",
+	})
+	got := candidateNames(idx, parseTrigramQuery(t, "foo|bar"))
+	if len(got) != 2 {
+		t.Errorf("foo|bar: got %v, want a.go and b.go", got)
+	}
+}
+
+func TestRegexpTrigramQueryRepetitionDegradesToAll(t *testing.T) {
+	// A repetition can match zero or more times, so no fixed substring is
+	// guaranteed present: the implied query must be trigramAll, never a
+	// false negative.
+	re := &syntax.Regexp{Op: syntax.OpStar, Sub: []*syntax.Regexp{
+		{Op: syntax.OpLiteral, Rune: []rune("foo")},
+	}}
+	q := regexpTrigramQuery(re)
+	if q.op != trigramAll {
+		t.Errorf("got op %v, want trigramAll", q.op)
+	}
+}
+
+func TestConcatTrigramQueryMergesAdjacentLiterals(t *testing.T) {
+	// concatTrigramQuery must merge adjacent OpLiteral children into one
+	// run before computing trigrams, so "foo"+"bar" (two separate Sub
+	// nodes, as an OpConcat can produce) still requires the trigram "oba",
+	// which straddles the boundary between them. Treating each Sub's
+	// trigrams independently would miss it and weaken the filter.
+	subs := []*syntax.Regexp{
+		{Op: syntax.OpLiteral, Rune: []rune("foo")},
+		{Op: syntax.OpLiteral, Rune: []rune("bar")},
+	}
+	q := concatTrigramQuery(subs)
+
+	idx := buildIndex(t, map[string]string{
+		"a.go": "package foobar\n",  // contiguous: has the "oba" trigram
+		"b.go": "package foo_bar\n", // not contiguous: lacks it
+	})
+	got := candidateNames(idx, q)
+	if !reflect.DeepEqual(got, []string{"a.go"}) {
+		t.Errorf("got %v, want [a.go]", got)
+	}
+}
+
+func TestIsLikelyBinary(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"empty", nil, false},
+		{"text", []byte("package search\n"), false},
+		{"null byte", []byte("abc\x00def"), true},
+		{"null byte past first 256", append(bytes.Repeat([]byte("a"), 300), 0), false},
+	}
+	for _, c := range cases {
+		if got := isLikelyBinary(c.data); got != c.want {
+			t.Errorf("isLikelyBinary(%s) = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestTrigramsOfShortData(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("a"), []byte("ab")} {
+		if got := trigramsOf(data); got != nil {
+			t.Errorf("trigramsOf(%q) = %v, want nil (too short for a trigram)", data, got)
+		}
+	}
+}
+
+func TestTrigramIndexPersistRoundTrips(t *testing.T) {
+	idx := buildIndex(t, map[string]string{
+		"a.go":        "package foo\nfunc Foo() {}\n",
+		"b.go":        "package bar\nfunc Bar() {}\n",
+		"binary.data": "\x00\x01\x02binary content that gets marked alwaysScan",
+	})
+
+	path := filepath.Join(t.TempDir(), "commit.trigrams")
+	if err := persistTrigramIndex(path, idx); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadTrigramIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got.files, idx.files) {
+		t.Errorf("files: got %v, want %v", got.files, idx.files)
+	}
+	if !reflect.DeepEqual(got.alwaysScan, idx.alwaysScan) {
+		t.Errorf("alwaysScan: got %v, want %v", got.alwaysScan, idx.alwaysScan)
+	}
+	if !reflect.DeepEqual(got.postings, idx.postings) {
+		t.Errorf("postings: got %v, want %v", got.postings, idx.postings)
+	}
+}
+
+func TestLoadTrigramIndexMissingFile(t *testing.T) {
+	if _, err := loadTrigramIndex(filepath.Join(t.TempDir(), "does-not-exist.trigrams")); err == nil {
+		t.Fatal("expected an error loading a trigram index that was never persisted")
+	}
+}
+
+func TestTrigramIndexOrWithUnconstrainedBranchIsAll(t *testing.T) {
+	// A trigramAll branch (what eg stringTrigramQuery("") degrades to)
+	// forces the whole OR to be unconstrained too, since a file could match
+	// purely through that branch.
+	q := &trigramQuery{op: trigramOr, subs: []*trigramQuery{
+		stringTrigramQuery("foo"),
+		allTrigramQuery(),
+	}}
+	idx := buildIndex(t, map[string]string{"a.go": "package foo\n"})
+	if ids := idx.candidateFileIDs(q); ids != nil {
+		t.Errorf("OR with an unconstrained branch should return nil, got %v", ids)
+	}
+}
@@ -0,0 +1,31 @@
+package search
+
+import (
+	"archive/zip"
+	"io"
+	"io/ioutil"
+)
+
+// readZipEntry returns f's uncompressed content. If closer is also an
+// io.ReaderAt (as the disk-backed Store's *os.File is) and f was stored
+// rather than deflated, its bytes are read directly out of the
+// underlying file at f's data offset, skipping the checksum-verifying
+// reader f.Open() would otherwise set up. Anything else falls back to the normal
+// Open-and-read path.
+func readZipEntry(closer io.Closer, f *zip.File) ([]byte, error) {
+	if ra, ok := closer.(io.ReaderAt); ok && f.Method == zip.Store {
+		if off, err := f.DataOffset(); err == nil {
+			buf := make([]byte, f.UncompressedSize64)
+			if _, err := io.ReadFull(io.NewSectionReader(ra, off, int64(f.UncompressedSize64)), buf); err == nil {
+				return buf, nil
+			}
+		}
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}